@@ -0,0 +1,32 @@
+// Package dnsjson defines the JSON structures used by httpstodns to
+// represent DNS responses, compatible with Google's DNS-over-HTTPS JSON
+// API (https://developers.google.com/speed/public-dns/docs/dns-over-https#api_specification).
+package dnsjson
+
+// Response represents a DNS reply.
+type Response struct {
+	Status int  `json:"Status"`
+	TC     bool `json:"TC"`
+	RD     bool `json:"RD"`
+	RA     bool `json:"RA"`
+	AD     bool `json:"AD"`
+	CD     bool `json:"CD"`
+
+	Question []RR `json:"Question,omitempty"`
+	Answer   []RR `json:"Answer,omitempty"`
+
+	// EDNSClientSubnet is the scope netmask the upstream applied to the
+	// EDNS Client Subnet option in its reply, as a CIDR (e.g.
+	// "1.2.3.0/24"), so downstream caches can key on it correctly. Empty
+	// if the upstream didn't return one.
+	EDNSClientSubnet string `json:"edns_client_subnet,omitempty"`
+}
+
+// RR represents a single DNS resource record, either a question or an
+// answer.
+type RR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL,omitempty"`
+	Data string `json:"data,omitempty"`
+}
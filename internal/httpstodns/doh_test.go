@@ -0,0 +1,83 @@
+package httpstodns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadDoHQuery(t *testing.T) {
+	msg := []byte{0xab, 0xcd, 0x01, 0x02, 0x03}
+
+	cases := []struct {
+		name    string
+		req     *http.Request
+		want    []byte
+		wantErr error
+	}{
+		{
+			name: "get",
+			req:  httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(msg), nil),
+			want: msg,
+		},
+		{
+			name:    "get missing dns param",
+			req:     httptest.NewRequest(http.MethodGet, "/dns-query", nil),
+			wantErr: errEmptyDNSParam,
+		},
+		{
+			name:    "get invalid base64",
+			req:     httptest.NewRequest(http.MethodGet, "/dns-query?dns=not-valid-base64!!", nil),
+			wantErr: errInvalidDNSParam,
+		},
+		{
+			name: "post",
+			req: postRequest(t, msg, map[string]string{
+				"Content-Type": "application/dns-message",
+			}),
+			want: msg,
+		},
+		{
+			name: "post wrong content type",
+			req: postRequest(t, msg, map[string]string{
+				"Content-Type": "application/json",
+			}),
+			wantErr: errUnsupportedMediaType,
+		},
+		{
+			name:    "unsupported method",
+			req:     httptest.NewRequest(http.MethodPut, "/dns-query", nil),
+			wantErr: errUnsupportedMethod,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readDoHQuery(tc.req)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("readDoHQuery() error = %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readDoHQuery() unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Fatalf("readDoHQuery() = %x, want %x", got, tc.want)
+			}
+		})
+	}
+}
+
+func postRequest(t *testing.T, body []byte, headers map[string]string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
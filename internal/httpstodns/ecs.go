@@ -0,0 +1,274 @@
+package httpstodns
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+// ECSPolicy controls how the EDNS Client Subnet option (RFC 7871) is
+// forwarded to upstream resolvers.
+type ECSPolicy string
+
+const (
+	// ECSPassthrough forwards whatever client subnet the HTTP client
+	// supplied, unmodified. This is the original dnss behavior.
+	ECSPassthrough ECSPolicy = "passthrough"
+
+	// ECSStrip never sends client subnet information upstream, regardless
+	// of what the HTTP client requested.
+	ECSStrip ECSPolicy = "strip"
+
+	// ECSAnonymize truncates the client subnet to /24 (IPv4) or /56 (IPv6)
+	// before forwarding, per the privacy recommendation in RFC 7871 §11.1.
+	ECSAnonymize ECSPolicy = "anonymize"
+
+	// ECSAuto derives the client subnet from the HTTP request's source
+	// address when the client didn't supply one explicitly, honoring
+	// X-Forwarded-For when the request comes from a trusted proxy.
+	ECSAuto ECSPolicy = "auto"
+)
+
+// anonymizeBits are the prefix lengths used by ECSAnonymize, matching the
+// recommendation in RFC 7871 §11.1.
+const (
+	anonymizeV4Bits = 24
+	anonymizeV6Bits = 56
+)
+
+// resolveClientSubnet applies s.ECSPolicy to determine the client subnet
+// (if any) to attach to the upstream query, given the subnet explicitly
+// requested via the edns_client_subnet parameter (may be nil) and the
+// incoming HTTP request.
+func (s *Server) resolveClientSubnet(requested *net.IPNet, req *http.Request) *net.IPNet {
+	switch s.ECSPolicy {
+	case ECSStrip:
+		return nil
+
+	case ECSAnonymize:
+		return anonymizeSubnet(requested)
+
+	case ECSAuto:
+		if requested != nil {
+			return requested
+		}
+		return s.subnetFromRequest(req)
+
+	default: // ECSPassthrough, or unset.
+		return requested
+	}
+}
+
+// anonymizeSubnet caps n to the RFC 7871 §11.1 privacy prefix lengths,
+// without ever making it more specific than what was requested.
+func anonymizeSubnet(n *net.IPNet) *net.IPNet {
+	if n == nil {
+		return nil
+	}
+
+	ip := n.IP
+	capBits := anonymizeV6Bits
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		capBits = anonymizeV4Bits
+	}
+
+	ones, _ := n.Mask.Size()
+	bits := capBits
+	if ones < bits {
+		bits = ones
+	}
+
+	mask := net.CIDRMask(bits, len(ip)*8)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// subnetFromRequest derives a /32 (or /128) client subnet from the source
+// address of req, resolving the real client through a trusted reverse
+// proxy's X-Forwarded-For header if applicable.
+func (s *Server) subnetFromRequest(req *http.Request) *net.IPNet {
+	ip := s.clientIP(req)
+	if ip == nil {
+		return nil
+	}
+
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+	}
+
+	mask := net.CIDRMask(bits, len(ip)*8)
+	return &net.IPNet{IP: ip, Mask: mask}
+}
+
+// clientIP returns the address of the original client that made req,
+// following X-Forwarded-For when req.RemoteAddr is a trusted proxy.
+func (s *Server) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil {
+		return nil
+	}
+
+	if !ipInNets(remoteIP, s.trustedProxyNets()) {
+		return remoteIP
+	}
+
+	xff := req.Header.Get("X-Forwarded-For")
+	if xff == "" {
+		return remoteIP
+	}
+
+	// The left-most address is the original client.
+	client := strings.TrimSpace(strings.Split(xff, ",")[0])
+	if ip := net.ParseIP(client); ip != nil {
+		return ip
+	}
+	return remoteIP
+}
+
+// trustedProxyNets lazily parses s.TrustedProxies, caching the result.
+func (s *Server) trustedProxyNets() []*net.IPNet {
+	s.trustedOnce.Do(func() {
+		for _, cidr := range s.TrustedProxies {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				glog.Warningf("httpstodns: invalid TrustedProxies entry %q: %v", cidr, err)
+				continue
+			}
+			s.trustedNets = append(s.trustedNets, n)
+		}
+	})
+	return s.trustedNets
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyECSPolicy enforces s.ECSPolicy on a wire-format query m, used by the
+// RFC 8484 /dns-query handler, which (unlike /resolve) receives its EDNS
+// Client Subnet option, if any, already embedded in the client's message
+// rather than as a separate query parameter.
+func (s *Server) applyECSPolicy(m *dns.Msg, req *http.Request) {
+	requested := extractClientSubnet(m)
+	effective := s.resolveClientSubnet(requested, req)
+	setClientSubnet(m, effective)
+}
+
+// extractClientSubnet returns the client subnet embedded in m's EDNS0
+// option, if any.
+func extractClientSubnet(m *dns.Msg) *net.IPNet {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return &net.IPNet{
+				IP:   e.Address,
+				Mask: net.CIDRMask(int(e.SourceNetmask), len(e.Address)*8),
+			}
+		}
+	}
+	return nil
+}
+
+// setClientSubnet replaces any EDNS Client Subnet option on m with one
+// derived from n, removing it entirely if n is nil.
+func setClientSubnet(m *dns.Msg, n *net.IPNet) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		if n == nil {
+			return
+		}
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		m.Extra = append(m.Extra, opt)
+	}
+
+	var kept []dns.EDNS0
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+
+	if n == nil {
+		return
+	}
+
+	e := new(dns.EDNS0_SUBNET)
+	e.Code = dns.EDNS0SUBNET
+	if ipv4 := n.IP.To4(); ipv4 != nil {
+		e.Family = 1
+		e.Address = ipv4
+	} else {
+		e.Family = 2
+		e.Address = n.IP
+	}
+	e.SourceScope = 0
+
+	ones, _ := n.Mask.Size()
+	e.SourceNetmask = uint8(ones)
+
+	opt.Option = append(opt.Option, e)
+}
+
+// responseClientSubnet extracts the scope netmask the upstream applied to
+// its EDNS Client Subnet reply, if any, formatted as a CIDR so it can be
+// used as a cache key by downstream caches. It returns "" when the
+// upstream didn't return an ECS option, or returned a SourceScope of 0,
+// which per RFC 7871 §7.1.1 means the answer isn't subnet-specific and so
+// has no cache-keying CIDR to report.
+func responseClientSubnet(m *dns.Msg) string {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		if e.SourceScope == 0 {
+			return ""
+		}
+
+		// IPv4 addresses may be unpacked in 16-byte form; use the 4-byte
+		// form so the scope is applied over 32 bits.
+		addr := e.Address
+		if ip4 := addr.To4(); e.Family == 1 && ip4 != nil {
+			addr = ip4
+		}
+
+		bits := len(addr) * 8
+		if int(e.SourceScope) > bits {
+			return ""
+		}
+
+		n := net.IPNet{
+			IP:   addr,
+			Mask: net.CIDRMask(int(e.SourceScope), bits),
+		}
+		return n.String()
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package httpstodns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return n
+}
+
+func TestResolveClientSubnet(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/resolve", nil)
+	req.RemoteAddr = "203.0.113.7:12345"
+
+	proxyReq := httptest.NewRequest(http.MethodGet, "/resolve", nil)
+	proxyReq.RemoteAddr = "10.0.0.1:12345"
+	proxyReq.Header.Set("X-Forwarded-For", "198.51.100.9, 10.0.0.1")
+
+	requested := mustCIDR(t, "192.0.2.0/24")
+
+	cases := []struct {
+		name      string
+		policy    ECSPolicy
+		proxies   []string
+		req       *http.Request
+		requested *net.IPNet
+		want      string // "" means nil
+	}{
+		{
+			name:      "passthrough forwards requested unmodified",
+			policy:    ECSPassthrough,
+			req:       req,
+			requested: requested,
+			want:      "192.0.2.0/24",
+		},
+		{
+			name:      "default (unset) behaves like passthrough",
+			req:       req,
+			requested: requested,
+			want:      "192.0.2.0/24",
+		},
+		{
+			name:      "strip always returns nil",
+			policy:    ECSStrip,
+			req:       req,
+			requested: requested,
+			want:      "",
+		},
+		{
+			name:      "anonymize caps IPv4 to /24",
+			policy:    ECSAnonymize,
+			req:       req,
+			requested: mustCIDR(t, "192.0.2.42/32"),
+			want:      "192.0.2.0/24",
+		},
+		{
+			name:      "anonymize never widens a coarser requested mask",
+			policy:    ECSAnonymize,
+			req:       req,
+			requested: mustCIDR(t, "192.0.0.0/16"),
+			want:      "192.0.0.0/16",
+		},
+		{
+			name:      "auto passes through an explicit request",
+			policy:    ECSAuto,
+			req:       req,
+			requested: requested,
+			want:      "192.0.2.0/24",
+		},
+		{
+			name:   "auto derives from RemoteAddr when untrusted",
+			policy: ECSAuto,
+			req:    req,
+			want:   "203.0.113.7/32",
+		},
+		{
+			name:    "auto honors X-Forwarded-For from a trusted proxy",
+			policy:  ECSAuto,
+			proxies: []string{"10.0.0.0/8"},
+			req:     proxyReq,
+			want:    "198.51.100.9/32",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{ECSPolicy: tc.policy, TrustedProxies: tc.proxies}
+			got := s.resolveClientSubnet(tc.requested, tc.req)
+			if tc.want == "" {
+				if got != nil {
+					t.Fatalf("resolveClientSubnet() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tc.want {
+				t.Fatalf("resolveClientSubnet() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResponseClientSubnet(t *testing.T) {
+	withSubnet := func(family uint16, addr net.IP, netmask, scope uint8) *dns.Msg {
+		m := &dns.Msg{}
+		o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		e := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        family,
+			SourceNetmask: netmask,
+			SourceScope:   scope,
+			Address:       addr,
+		}
+		o.Option = append(o.Option, e)
+		m.Extra = append(m.Extra, o)
+		return m
+	}
+
+	cases := []struct {
+		name string
+		msg  *dns.Msg
+		want string
+	}{
+		{
+			name: "no OPT record",
+			msg:  &dns.Msg{},
+			want: "",
+		},
+		{
+			name: "scope 0 means not subnet-specific",
+			msg:  withSubnet(1, net.ParseIP("1.2.3.0").To4(), 24, 0),
+			want: "",
+		},
+		{
+			name: "scope wider than the address is invalid",
+			msg:  withSubnet(1, net.ParseIP("1.2.3.0").To4(), 24, 200),
+			want: "",
+		},
+		{
+			name: "valid IPv4 scope",
+			msg:  withSubnet(1, net.ParseIP("1.2.3.0").To4(), 24, 24),
+			want: "1.2.3.0/24",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := responseClientSubnet(tc.msg); got != tc.want {
+				t.Fatalf("responseClientSubnet() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
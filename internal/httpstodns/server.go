@@ -3,28 +3,94 @@
 package httpstodns
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
 	"blitiri.com.ar/go/dnss/internal/dnsjson"
+	"blitiri.com.ar/go/dnss/internal/upstream"
 	"blitiri.com.ar/go/dnss/internal/util"
 	"github.com/golang/glog"
 	"github.com/miekg/dns"
 	"golang.org/x/net/trace"
 )
 
-// Server is an HTTPS server that implements DNS over HTTPS, as specified in
-// https://developers.google.com/speed/public-dns/docs/dns-over-https#api_specification.
+// dohMaxMsgSize is the largest DNS message we're willing to read from a
+// DoH client, as a safety limit. It's much larger than any sane query.
+const dohMaxMsgSize = 64 * 1024
+
+// Server is an HTTPS server that implements DNS over HTTPS. It serves the
+// legacy Google JSON API
+// (https://developers.google.com/speed/public-dns/docs/dns-over-https#api_specification)
+// on /resolve, and the standard wire-format protocol (RFC 8484) on
+// /dns-query.
 type Server struct {
-	Addr     string
+	Addr string
+
+	// Upstream is a comma-separated list of one or more upstream
+	// configuration strings, as accepted by upstream.New. A single entry
+	// is exchanged with directly; more than one turns it into a pool,
+	// driven by Strategy.
 	Upstream string
+
+	// Strategy selects how queries are spread across Upstream's entries
+	// when there is more than one. Defaults to upstream.Sequential.
+	Strategy upstream.Strategy
+
 	CertFile string
 	KeyFile  string
+
+	// BootstrapDNS is the "host:port" of a plain DNS server used to resolve
+	// upstream hostnames, for tls:// and https:// upstreams that are
+	// dialed directly and so can't rely on the system resolver. If empty,
+	// upstream.DefaultBootstrap is used.
+	BootstrapDNS string
+
+	// ECSPolicy controls how the EDNS Client Subnet option is forwarded
+	// upstream. Defaults to ECSPassthrough.
+	ECSPolicy ECSPolicy
+
+	// TrustedProxies is a list of CIDRs for reverse proxies allowed to set
+	// the X-Forwarded-For header, consulted when ECSPolicy is ECSAuto.
+	TrustedProxies []string
+
+	upstreamOnce sync.Once
+	upstreamImpl upstream.Upstream
+	upstreamErr  error
+
+	trustedOnce sync.Once
+	trustedNets []*net.IPNet
+}
+
+// resolveUpstream lazily parses s.Upstream into an upstream.Upstream
+// (building a pool if there's more than one entry), caching the result for
+// subsequent requests.
+func (s *Server) resolveUpstream() (upstream.Upstream, error) {
+	s.upstreamOnce.Do(func() {
+		specs := strings.Split(s.Upstream, ",")
+		for i := range specs {
+			specs[i] = strings.TrimSpace(specs[i])
+		}
+
+		if len(specs) == 1 {
+			s.upstreamImpl, s.upstreamErr = upstream.New(specs[0], s.BootstrapDNS)
+			return
+		}
+
+		strategy := s.Strategy
+		if strategy == "" {
+			strategy = upstream.Sequential
+		}
+		s.upstreamImpl, s.upstreamErr = upstream.NewPool(specs, s.BootstrapDNS, strategy)
+	})
+	return s.upstreamImpl, s.upstreamErr
 }
 
 // InsecureForTesting = true will make Server.ListenAndServe will not use TLS.
@@ -35,6 +101,7 @@ var InsecureForTesting = false
 func (s *Server) ListenAndServe() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/resolve", s.Resolve)
+	mux.HandleFunc("/dns-query", s.DoH)
 	srv := http.Server{
 		Addr:    s.Addr,
 		Handler: mux,
@@ -72,22 +139,23 @@ func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
 	r.CheckingDisabled = q.cd
 	r.SetQuestion(dns.Fqdn(q.name), q.rrType)
 
-	if q.clientSubnet != nil {
+	clientSubnet := s.resolveClientSubnet(q.clientSubnet, req)
+	if clientSubnet != nil {
 		o := new(dns.OPT)
 		o.Hdr.Name = "."
 		o.Hdr.Rrtype = dns.TypeOPT
 		e := new(dns.EDNS0_SUBNET)
 		e.Code = dns.EDNS0SUBNET
-		if ipv4 := q.clientSubnet.IP.To4(); ipv4 != nil {
+		if ipv4 := clientSubnet.IP.To4(); ipv4 != nil {
 			e.Family = 1 // IPv4 source address
 			e.Address = ipv4
 		} else {
 			e.Family = 2 // IPv6 source address
-			e.Address = q.clientSubnet.IP
+			e.Address = clientSubnet.IP
 		}
 		e.SourceScope = 0
 
-		_, maskSize := q.clientSubnet.Mask.Size()
+		maskSize, _ := clientSubnet.Mask.Size()
 		e.SourceNetmask = uint8(maskSize)
 
 		o.Option = append(o.Option, e)
@@ -96,8 +164,15 @@ func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
 
 	util.TraceQuestion(tr, r.Question)
 
+	up, err := s.resolveUpstream()
+	if err != nil {
+		err = util.TraceErrorf(tr, "invalid upstream: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Do the DNS request, get the reply.
-	fromUp, err := dns.Exchange(r, s.Upstream)
+	fromUp, err := up.Exchange(r)
 	if err != nil {
 		err = util.TraceErrorf(tr, "dns exchange error: %v", err)
 		http.Error(w, err.Error(), http.StatusFailedDependency)
@@ -143,6 +218,10 @@ func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
 		jr.Answer = append(jr.Answer, ja)
 	}
 
+	if scope := responseClientSubnet(fromUp); scope != "" {
+		jr.EDNSClientSubnet = scope
+	}
+
 	buf, err := json.Marshal(jr)
 	if err != nil {
 		err = util.TraceErrorf(tr, "failed to marshal: %v", err)
@@ -153,6 +232,116 @@ func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
 	w.Write(buf)
 }
 
+// DoH handles "DNS over HTTPS" requests in RFC 8484 wire format, as used by
+// cloudflared, AdGuard Home, and browsers with native DoH support. It
+// implements an http.HandlerFunc so it can be used with any standard Go
+// HTTP server.
+func (s *Server) DoH(w http.ResponseWriter, req *http.Request) {
+	tr := trace.New("httpstodns", "/dns-query")
+	defer tr.Finish()
+
+	tr.LazyPrintf("from:%v", req.RemoteAddr)
+
+	rawQuery, err := readDoHQuery(req)
+	if err != nil {
+		util.TraceError(tr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r := &dns.Msg{}
+	if err := r.Unpack(rawQuery); err != nil {
+		err = util.TraceErrorf(tr, "invalid dns message: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.applyECSPolicy(r, req)
+
+	util.TraceQuestion(tr, r.Question)
+
+	up, err := s.resolveUpstream()
+	if err != nil {
+		err = util.TraceErrorf(tr, "invalid upstream: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fromUp, err := up.Exchange(r)
+	if err != nil {
+		err = util.TraceErrorf(tr, "dns exchange error: %v", err)
+		http.Error(w, err.Error(), http.StatusFailedDependency)
+		return
+	}
+
+	if fromUp == nil {
+		err = util.TraceErrorf(tr, "no response from upstream")
+		http.Error(w, err.Error(), http.StatusRequestTimeout)
+		return
+	}
+
+	util.TraceAnswer(tr, fromUp)
+
+	packed, err := fromUp.Pack()
+	if err != nil {
+		err = util.TraceErrorf(tr, "failed to pack reply: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(fromUp)))
+	w.Write(packed)
+}
+
+// readDoHQuery extracts the raw DNS wire-format message from a RFC 8484
+// request, which can arrive either as a base64url-encoded "dns" query
+// parameter on GET, or as a raw "application/dns-message" body on POST.
+func readDoHQuery(req *http.Request) ([]byte, error) {
+	switch req.Method {
+	case http.MethodGet:
+		b64 := req.URL.Query().Get("dns")
+		if b64 == "" {
+			return nil, errEmptyDNSParam
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, errInvalidDNSParam
+		}
+		return raw, nil
+
+	case http.MethodPost:
+		if ct := req.Header.Get("Content-Type"); ct != "application/dns-message" {
+			return nil, errUnsupportedMediaType
+		}
+		raw, err := io.ReadAll(io.LimitReader(req.Body, dohMaxMsgSize))
+		if err != nil {
+			return nil, fmt.Errorf("error reading body: %v", err)
+		}
+		return raw, nil
+
+	default:
+		return nil, errUnsupportedMethod
+	}
+}
+
+// minTTL returns the smallest TTL among m's answer records, for use in a
+// Cache-Control header. If there are no answers, it returns 0 so the
+// response is not cached.
+func minTTL(m *dns.Msg) uint32 {
+	if len(m.Answer) == 0 {
+		return 0
+	}
+
+	min := m.Answer[0].Header().Ttl
+	for _, rr := range m.Answer[1:] {
+		if ttl := rr.Header().Ttl; ttl < min {
+			min = ttl
+		}
+	}
+	return min
+}
+
 type query struct {
 	name   string
 	rrType uint16
@@ -173,6 +362,11 @@ var (
 	errIntOutOfRange = fmt.Errorf("invalid type (int out of range)")
 	errUnknownType   = fmt.Errorf("invalid type (unknown string type)")
 	errInvalidCD     = fmt.Errorf("invalid cd value")
+
+	errEmptyDNSParam        = fmt.Errorf("missing dns query parameter")
+	errInvalidDNSParam      = fmt.Errorf("invalid base64url in dns query parameter")
+	errUnsupportedMediaType = fmt.Errorf("unsupported media type, expected application/dns-message")
+	errUnsupportedMethod    = fmt.Errorf("unsupported method, expected GET or POST")
 )
 
 func parseQuery(u *url.URL) (query, error) {
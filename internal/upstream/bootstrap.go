@@ -0,0 +1,56 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// splitHostPort splits a URL host component (as in url.URL.Host) into host
+// and port, applying defaultPort when none was given. Unlike
+// net.SplitHostPort, it also accepts a bare (portless) bracketed IPv6
+// literal, such as "[2001:db8::1]", stripping the brackets.
+func splitHostPort(hostport, defaultPort string) (host, port string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return trimBrackets(hostport), defaultPort
+	}
+	return host, port
+}
+
+// trimBrackets strips the "[" "]" around a bracketed IPv6 literal, if
+// present.
+func trimBrackets(host string) string {
+	if len(host) >= 2 && host[0] == '[' && host[len(host)-1] == ']' {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// bootstrapResolve resolves host to an address suitable for dialing,
+// returning "ip:port". If host is already a literal IP address, it is used
+// directly. Otherwise, an A query for host is sent to the bootstrap DNS
+// server.
+func bootstrapResolve(host, port, bootstrap string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(host, port), nil
+	}
+
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+
+	client := &dns.Client{}
+	r, _, err := client.Exchange(m, bootstrap)
+	if err != nil {
+		return "", fmt.Errorf("upstream: bootstrap resolve of %q via %q: %v", host, bootstrap, err)
+	}
+
+	for _, rr := range r.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return net.JoinHostPort(a.A.String(), port), nil
+		}
+	}
+
+	return "", fmt.Errorf("upstream: bootstrap resolve of %q via %q: no A record found", host, bootstrap)
+}
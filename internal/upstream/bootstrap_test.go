@@ -0,0 +1,52 @@
+package upstream
+
+import "testing"
+
+func TestSplitHostPort(t *testing.T) {
+	cases := []struct {
+		name        string
+		hostport    string
+		defaultPort string
+		wantHost    string
+		wantPort    string
+	}{
+		{
+			name:        "host and port",
+			hostport:    "dns.example:853",
+			defaultPort: "443",
+			wantHost:    "dns.example",
+			wantPort:    "853",
+		},
+		{
+			name:        "host only, applies default port",
+			hostport:    "dns.example",
+			defaultPort: "443",
+			wantHost:    "dns.example",
+			wantPort:    "443",
+		},
+		{
+			name:        "bracketed IPv6 with port",
+			hostport:    "[2001:db8::1]:853",
+			defaultPort: "443",
+			wantHost:    "2001:db8::1",
+			wantPort:    "853",
+		},
+		{
+			name:        "bracketed IPv6 with no port strips brackets",
+			hostport:    "[2001:db8::1]",
+			defaultPort: "443",
+			wantHost:    "2001:db8::1",
+			wantPort:    "443",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			host, port := splitHostPort(tc.hostport, tc.defaultPort)
+			if host != tc.wantHost || port != tc.wantPort {
+				t.Fatalf("splitHostPort(%q, %q) = (%q, %q), want (%q, %q)",
+					tc.hostport, tc.defaultPort, host, port, tc.wantHost, tc.wantPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMaxMsgSize is the largest DNS message we're willing to read from a DoH
+// upstream, as a safety limit.
+const dohMaxMsgSize = 64 * 1024
+
+// dohTimeout bounds the whole request/response round trip, matching the
+// ~2s default dns.Client uses for the classic and DoT transports, so a
+// hung DoH upstream can't block a handler goroutine (or leak a goroutine
+// in Pool's parallel strategy) indefinitely.
+const dohTimeout = 2 * time.Second
+
+// httpsUpstream implements Upstream over DNS-over-HTTPS (RFC 8484, wire
+// format), as opposed to the legacy JSON API.
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPS(u *url.URL, bootstrap string) *httpsUpstream {
+	host, port := splitHostPort(u.Host, "443")
+
+	// Resolve at dial time, rather than once here: this keeps us from
+	// permanently pinning a stale address, and from caching a transient
+	// bootstrap resolution failure for the life of the process. A dial
+	// only happens when http.Transport needs a new connection, so this
+	// also naturally picks up an upstream IP change on reconnect.
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr, err := bootstrapResolve(host, port, bootstrap)
+			if err != nil {
+				return nil, err
+			}
+			return tls.DialWithDialer(dialer, network, addr, &tls.Config{ServerName: host})
+		},
+	}
+
+	return &httpsUpstream{
+		url:    u.String(),
+		client: &http.Client{Transport: transport, Timeout: dohTimeout},
+	}
+}
+
+func (h *httpsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("upstream: failed to pack query: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: doh request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream: doh request returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("upstream: failed to read doh response: %v", err)
+	}
+
+	r := &dns.Msg{}
+	if err := r.Unpack(body); err != nil {
+		return nil, fmt.Errorf("upstream: invalid doh response: %v", err)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,264 @@
+package upstream
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// Strategy selects how a Pool picks among its members for each query.
+type Strategy string
+
+const (
+	// Sequential tries members in order, falling back to the next one on
+	// error. This is the default.
+	Sequential Strategy = "sequential"
+
+	// Parallel fans the query out to all healthy members at once, and
+	// returns the first successful reply.
+	Parallel Strategy = "parallel"
+
+	// LoadBalance picks among healthy members at random, weighted towards
+	// those with lower observed latency.
+	LoadBalance Strategy = "load_balance"
+)
+
+const (
+	// healthCheckInterval is how often pool members are health-checked.
+	healthCheckInterval = 30 * time.Second
+
+	// healthCheckName is a well-known, stable name used as a canned health
+	// check query.
+	healthCheckName = "dns.google."
+)
+
+// member wraps a single Upstream with the health and latency state used by
+// the pool's selection strategies.
+type member struct {
+	addr     string // original configuration string, for tracing/logging
+	upstream Upstream
+
+	mu      sync.Mutex
+	healthy bool
+	latency time.Duration
+}
+
+func (m *member) snapshot() (healthy bool, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.healthy, m.latency
+}
+
+func (m *member) record(latency time.Duration, healthy bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = latency
+	m.healthy = healthy
+}
+
+// Pool is an Upstream that spreads queries across multiple upstreams,
+// according to a Strategy, skipping members that a background health check
+// has found to be failing. A Pool's health checker runs for the lifetime of
+// the process; dnss has no server shutdown path for it to hook into, so
+// Pool has no Close method to mirror.
+type Pool struct {
+	strategy Strategy
+	members  []*member
+
+	events trace.EventLog
+}
+
+// NewPool builds a Pool from a list of upstream configuration strings (see
+// New), and starts its background health checker.
+func NewPool(specs []string, bootstrap string, strategy Strategy) (*Pool, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("upstream: empty pool")
+	}
+
+	p := &Pool{
+		strategy: strategy,
+		events:   trace.NewEventLog("upstream.Pool", fmt.Sprintf("%v", specs)),
+	}
+
+	for _, spec := range specs {
+		up, err := New(spec, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		// Assume healthy until the first health check proves otherwise, so
+		// a pool is usable immediately after construction.
+		p.members = append(p.members, &member{addr: spec, upstream: up, healthy: true})
+	}
+
+	go p.healthCheckLoop()
+	return p, nil
+}
+
+func (p *Pool) healthCheckLoop() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	// Run one check immediately, so health state isn't all guesswork until
+	// the first tick.
+	p.checkAll()
+
+	for range ticker.C {
+		p.checkAll()
+	}
+}
+
+func (p *Pool) checkAll() {
+	for _, m := range p.members {
+		go p.check(m)
+	}
+}
+
+func (p *Pool) check(m *member) {
+	q := &dns.Msg{}
+	q.SetQuestion(healthCheckName, dns.TypeA)
+
+	start := time.Now()
+	r, err := m.upstream.Exchange(q)
+	latency := time.Since(start)
+
+	healthy := err == nil && r != nil && r.Rcode == dns.RcodeSuccess
+	m.record(latency, healthy)
+
+	p.events.Printf("healthcheck %s: healthy=%v latency=%v err=%v", m.addr, healthy, latency, err)
+}
+
+// healthyMembers returns the members currently considered healthy, or all
+// members if none are healthy (so a pool with a flaky health check still
+// serves queries, rather than failing closed).
+func (p *Pool) healthyMembers() []*member {
+	var healthy []*member
+	for _, m := range p.members {
+		if ok, _ := m.snapshot(); ok {
+			healthy = append(healthy, m)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.members
+	}
+	return healthy
+}
+
+// Exchange implements Upstream.
+func (p *Pool) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	switch p.strategy {
+	case Parallel:
+		return p.exchangeParallel(m)
+	case LoadBalance:
+		return p.exchangeLoadBalance(m)
+	default:
+		return p.exchangeSequential(m)
+	}
+}
+
+func (p *Pool) exchangeSequential(q *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, m := range p.healthyMembers() {
+		r, err := m.upstream.Exchange(q)
+		if err == nil {
+			return r, nil
+		}
+		lastErr = err
+		p.events.Printf("sequential: %s failed: %v", m.addr, err)
+	}
+	return nil, fmt.Errorf("upstream: all pool members failed, last error: %v", lastErr)
+}
+
+type parallelResult struct {
+	reply *dns.Msg
+	err   error
+}
+
+func (p *Pool) exchangeParallel(q *dns.Msg) (*dns.Msg, error) {
+	members := p.healthyMembers()
+	results := make(chan parallelResult, len(members))
+
+	for _, m := range members {
+		m := m
+		go func() {
+			r, err := m.upstream.Exchange(q)
+			results <- parallelResult{reply: r, err: err}
+		}()
+	}
+
+	var lastErr error
+	for range members {
+		res := <-results
+		if res.err == nil {
+			return res.reply, nil
+		}
+		lastErr = res.err
+	}
+	return nil, fmt.Errorf("upstream: all pool members failed, last error: %v", lastErr)
+}
+
+// exchangeLoadBalance picks a healthy member weighted by latency, and
+// falls back to the rest of the healthy members on error: the health
+// checker only runs every healthCheckInterval, so a member can be
+// momentarily failing without having been marked unhealthy yet, and
+// load_balance should be as resilient to that as sequential/parallel are.
+func (p *Pool) exchangeLoadBalance(q *dns.Msg) (*dns.Msg, error) {
+	members := p.healthyMembers()
+	first := p.pickWeighted(members)
+
+	r, err := first.upstream.Exchange(q)
+	if err == nil {
+		return r, nil
+	}
+	p.events.Printf("load_balance: %s failed: %v", first.addr, err)
+	lastErr := err
+
+	for _, m := range members {
+		if m == first {
+			continue
+		}
+		r, err := m.upstream.Exchange(q)
+		if err == nil {
+			return r, nil
+		}
+		p.events.Printf("load_balance: %s failed: %v", m.addr, err)
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("upstream: all pool members failed, last error: %v", lastErr)
+}
+
+// pickWeighted picks a member from members at random, weighted towards
+// lower latency: each member's weight is the inverse of its last observed
+// latency, so consistently fast upstreams are selected more often.
+func (p *Pool) pickWeighted(members []*member) *member {
+	if len(members) == 1 {
+		return members[0]
+	}
+
+	weights := make([]float64, len(members))
+	var total float64
+	for i, m := range members {
+		_, latency := m.snapshot()
+		// Members with no latency sample yet (not yet checked) get a
+		// weight of 1.0, the same as a member with a 1s latency.
+		w := 1.0
+		if latency > 0 {
+			w = float64(time.Second) / float64(latency)
+		}
+		weights[i] = w
+		total += w
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r <= 0 {
+			return members[i]
+		}
+	}
+	return members[len(members)-1]
+}
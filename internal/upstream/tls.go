@@ -0,0 +1,37 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+// tlsUpstream implements Upstream over DNS-over-TLS (RFC 7858).
+type tlsUpstream struct {
+	host      string // hostname or IP to resolve and dial
+	port      string
+	bootstrap string
+}
+
+func newTLS(u *url.URL, bootstrap string) *tlsUpstream {
+	host, port := splitHostPort(u.Host, "853")
+	return &tlsUpstream{host: host, port: port, bootstrap: bootstrap}
+}
+
+func (t *tlsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	// Resolve at dial time, rather than once at construction: this keeps
+	// us from permanently pinning a stale address, and from caching a
+	// transient bootstrap resolution failure for the life of the process.
+	addr, err := bootstrapResolve(t.host, t.port, t.bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{ServerName: t.host},
+	}
+	r, _, err := client.Exchange(m, addr)
+	return r, err
+}
@@ -0,0 +1,72 @@
+// Package upstream implements the DNS transports that dnss can forward
+// queries to: classic UDP/TCP, DNS-over-TLS (RFC 7858) and DNS-over-HTTPS
+// (RFC 8484, wire format).
+package upstream
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultBootstrap is the resolver used to look up upstream hostnames when
+// no BootstrapDNS is configured, avoiding a dependency on the system
+// resolver (which may itself depend on dnss).
+const DefaultBootstrap = "8.8.8.8:53"
+
+// Upstream forwards a DNS query to a server and returns its reply.
+type Upstream interface {
+	Exchange(m *dns.Msg) (*dns.Msg, error)
+}
+
+// New builds an Upstream from a configuration string, which is either a
+// bare "host:port" (classic UDP, for backwards compatibility) or a URL
+// with one of the following schemes:
+//
+//	udp://host:port    classic DNS over UDP
+//	tcp://host:port    classic DNS over TCP
+//	tls://host:port    DNS-over-TLS (RFC 7858), default port 853
+//	https://host/path  DNS-over-HTTPS (RFC 8484), default port 443
+//
+// bootstrap is the "host:port" of a plain DNS server used to resolve the
+// upstream's hostname at dial time for tls:// and https:// upstreams,
+// since those are dialed directly and can't rely on the system resolver.
+// If empty, DefaultBootstrap is used.
+func New(spec, bootstrap string) (Upstream, error) {
+	if bootstrap == "" {
+		bootstrap = DefaultBootstrap
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" || u.Opaque != "" {
+		// No recognizable scheme: treat it as a bare host:port, as dnss
+		// has always done.
+		return &classic{net: "udp", addr: spec}, nil
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &classic{net: "udp", addr: u.Host}, nil
+	case "tcp":
+		return &classic{net: "tcp", addr: u.Host}, nil
+	case "tls":
+		return newTLS(u, bootstrap), nil
+	case "https":
+		return newHTTPS(u, bootstrap), nil
+	default:
+		return nil, fmt.Errorf("upstream: unknown scheme %q in %q", u.Scheme, spec)
+	}
+}
+
+// classic implements Upstream over plain UDP or TCP.
+type classic struct {
+	net  string // "udp" or "tcp"
+	addr string
+}
+
+func (c *classic) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: c.net}
+	r, _, err := client.Exchange(m, c.addr)
+	return r, err
+}
@@ -0,0 +1,94 @@
+package upstream
+
+import "testing"
+
+func TestNewClassification(t *testing.T) {
+	cases := []struct {
+		name string
+		spec string
+		// check asserts the concrete type and any fields it cares about.
+		check   func(t *testing.T, got Upstream)
+		wantErr bool
+	}{
+		{
+			name: "bare host port defaults to udp",
+			spec: "8.8.8.8:53",
+			check: func(t *testing.T, got Upstream) {
+				c, ok := got.(*classic)
+				if !ok {
+					t.Fatalf("got %T, want *classic", got)
+				}
+				if c.net != "udp" || c.addr != "8.8.8.8:53" {
+					t.Fatalf("got net=%q addr=%q, want net=udp addr=8.8.8.8:53", c.net, c.addr)
+				}
+			},
+		},
+		{
+			name: "explicit udp scheme",
+			spec: "udp://8.8.8.8:53",
+			check: func(t *testing.T, got Upstream) {
+				c, ok := got.(*classic)
+				if !ok || c.net != "udp" {
+					t.Fatalf("got %#v, want *classic with net=udp", got)
+				}
+			},
+		},
+		{
+			name: "explicit tcp scheme",
+			spec: "tcp://8.8.8.8:53",
+			check: func(t *testing.T, got Upstream) {
+				c, ok := got.(*classic)
+				if !ok || c.net != "tcp" {
+					t.Fatalf("got %#v, want *classic with net=tcp", got)
+				}
+			},
+		},
+		{
+			name: "tls scheme with IP literal, default port",
+			spec: "tls://1.1.1.1",
+			check: func(t *testing.T, got Upstream) {
+				tu, ok := got.(*tlsUpstream)
+				if !ok {
+					t.Fatalf("got %T, want *tlsUpstream", got)
+				}
+				if tu.host != "1.1.1.1" || tu.port != "853" {
+					t.Fatalf("got host=%q port=%q, want host=1.1.1.1 port=853", tu.host, tu.port)
+				}
+			},
+		},
+		{
+			name: "https scheme with IP literal and path",
+			spec: "https://1.1.1.1/dns-query",
+			check: func(t *testing.T, got Upstream) {
+				hu, ok := got.(*httpsUpstream)
+				if !ok {
+					t.Fatalf("got %T, want *httpsUpstream", got)
+				}
+				if hu.url != "https://1.1.1.1/dns-query" {
+					t.Fatalf("got url=%q, want https://1.1.1.1/dns-query", hu.url)
+				}
+			},
+		},
+		{
+			name:    "unknown scheme",
+			spec:    "ftp://8.8.8.8",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := New(tc.spec, "")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("New(%q) succeeded, want error", tc.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New(%q) unexpected error: %v", tc.spec, err)
+			}
+			tc.check(t, got)
+		})
+	}
+}